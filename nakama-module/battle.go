@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// --- Match op codes ---
+
+const (
+	OpCodeAction      int64 = 1
+	OpCodeMatchState  int64 = 2
+	OpCodeMatchResult int64 = 3
+)
+
+// --- Match action payload (client -> server) ---
+
+type BattleAction struct {
+	Type           string `json:"type"` // attack | ability | defend | end_turn
+	UnitInstanceId string `json:"unitInstanceId"`
+	TargetUnitId   string `json:"targetUnitId,omitempty"`
+	Style          string `json:"style,omitempty"` // melee | ranged | magic, for attack
+}
+
+// --- Match state ---
+
+type battleCombatant struct {
+	UserID     string   `json:"userId"`
+	UnitId     string   `json:"unitId"`
+	Stats      StatsMap `json:"stats"`
+	HP         int64    `json:"hp"`
+	Defending  bool     `json:"defending"`
+	DamageDone int64    `json:"damageDone"`
+}
+
+type battleParty struct {
+	Presence  runtime.Presence
+	UserID    string
+	Combatants []*battleCombatant
+}
+
+type battleMatchState struct {
+	rng           *rand.Rand
+	parties       map[string]*battleParty // keyed by userID
+	pendingUnitIds map[string][]string    // userID -> unit instance IDs submitted at join, consumed by MatchJoin
+	order         []string                // combatant keys (userId:unitId) in initiative order
+	turnIdx       int
+	idleTicks     int
+	started       bool
+	over          bool
+}
+
+func combatantKey(userID, unitId string) string {
+	return userID + ":" + unitId
+}
+
+// hashMatchIdSeed derives a deterministic int64 seed from the match ID so
+// every node replaying this match's events reaches the same outcome.
+func hashMatchIdSeed(ctx context.Context) int64 {
+	matchID, _ := ctx.Value(runtime.RUNTIME_CTX_MATCH_ID).(string)
+	h := fnv.New64a()
+	h.Write([]byte(matchID))
+	return int64(h.Sum64())
+}
+
+// --- Match handler ---
+
+type BattleMatch struct{}
+
+func (m *BattleMatch) MatchInit(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, params map[string]interface{}) (interface{}, int, string) {
+	state := &battleMatchState{
+		rng:            rand.New(rand.NewSource(hashMatchIdSeed(ctx))),
+		parties:        make(map[string]*battleParty),
+		pendingUnitIds: make(map[string][]string),
+	}
+	// rpc_create_battle pre-seeds the creator's party here so they don't have
+	// to repeat it as join metadata; other joiners still supply theirs via
+	// MatchJoinAttempt's "party" metadata.
+	if creatorUserId, ok := params["createdBy"].(string); ok && creatorUserId != "" {
+		if unitIds := creatorPartyFromParams(params["creatorParty"]); len(unitIds) > 0 {
+			state.pendingUnitIds[creatorUserId] = unitIds
+		}
+	}
+	tickRate := 2
+	label := BattleMatchModule
+	return state, tickRate, label
+}
+
+// creatorPartyFromParams recovers a []string party from MatchCreate's
+// params, which may hand it back as []string (in-process) or []interface{}
+// (if a runtime round-trips params through JSON).
+func creatorPartyFromParams(raw interface{}) []string {
+	switch v := raw.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		unitIds := make([]string, 0, len(v))
+		for _, entry := range v {
+			if s, ok := entry.(string); ok {
+				unitIds = append(unitIds, s)
+			}
+		}
+		return unitIds
+	default:
+		return nil
+	}
+}
+
+func (m *BattleMatch) MatchJoinAttempt(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presence runtime.Presence, metadata map[string]string) (interface{}, bool, string) {
+	s := state.(*battleMatchState)
+	if s.started {
+		return s, false, "match_already_started"
+	}
+	if len(s.parties) >= BattleMaxParties {
+		return s, false, "match_full"
+	}
+	if metadata["party"] != "" {
+		var unitIds []string
+		if err := json.Unmarshal([]byte(metadata["party"]), &unitIds); err != nil || len(unitIds) == 0 {
+			return s, false, "invalid_party_metadata"
+		}
+		s.pendingUnitIds[presence.GetUserId()] = unitIds
+	} else if _, ok := s.pendingUnitIds[presence.GetUserId()]; !ok {
+		// No join metadata and no party pre-seeded by rpc_create_battle.
+		return s, false, "missing_party_metadata"
+	}
+	return s, true, ""
+}
+
+func (m *BattleMatch) MatchJoin(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presences []runtime.Presence) interface{} {
+	s := state.(*battleMatchState)
+	for _, presence := range presences {
+		unitIds := s.pendingUnitIds[presence.GetUserId()]
+
+		inv := initInventory()
+		inventoryJSON, err := readStorage(ctx, nk, presence.GetUserId(), CollectionInventory, StorageKeyInventory)
+		if err == nil && inventoryJSON != "" {
+			_ = json.Unmarshal([]byte(inventoryJSON), inv)
+		}
+
+		party := &battleParty{Presence: presence, UserID: presence.GetUserId()}
+		for _, unitId := range unitIds {
+			unit, final, err := computeFinalStats(inv, unitId)
+			if err != nil {
+				continue
+			}
+			party.Combatants = append(party.Combatants, &battleCombatant{
+				UserID: presence.GetUserId(),
+				UnitId: unit.InstanceId,
+				Stats:  final,
+				HP:     final["hp_max"],
+			})
+		}
+		s.parties[presence.GetUserId()] = party
+	}
+
+	if len(s.parties) == BattleMaxParties && !s.started {
+		s.started = true
+		s.order = s.buildInitiativeOrder()
+		dispatcher.BroadcastMessage(OpCodeMatchState, s.snapshot(), nil, nil, true)
+	}
+	return s
+}
+
+func (s *battleMatchState) buildInitiativeOrder() []string {
+	type entry struct {
+		key      string
+		maneuver int64
+		jitter   int64
+	}
+	entries := make([]entry, 0)
+	for _, party := range s.parties {
+		for _, c := range party.Combatants {
+			entries = append(entries, entry{
+				key:      combatantKey(c.UserID, c.UnitId),
+				maneuver: c.Stats["maneuver"],
+				jitter:   s.rng.Int63(),
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].maneuver != entries[j].maneuver {
+			return entries[i].maneuver > entries[j].maneuver
+		}
+		return entries[i].jitter > entries[j].jitter
+	})
+	order := make([]string, len(entries))
+	for i, e := range entries {
+		order[i] = e.key
+	}
+	return order
+}
+
+func (s *battleMatchState) combatant(key string) *battleCombatant {
+	for _, party := range s.parties {
+		for _, c := range party.Combatants {
+			if combatantKey(c.UserID, c.UnitId) == key {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func (s *battleMatchState) partyAlive(userID string) bool {
+	party, ok := s.parties[userID]
+	if !ok {
+		return false
+	}
+	for _, c := range party.Combatants {
+		if c.HP > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *battleMatchState) advanceTurn() {
+	for i := 0; i < len(s.order); i++ {
+		s.turnIdx = (s.turnIdx + 1) % len(s.order)
+		if c := s.combatant(s.order[s.turnIdx]); c != nil && c.HP > 0 {
+			return
+		}
+	}
+}
+
+func (s *battleMatchState) snapshot() []byte {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"parties": s.parties,
+		"order":   s.order,
+		"turnIdx": s.turnIdx,
+	})
+	return raw
+}
+
+// deriveDefense turns a unit's toughness stats into a flat defense value
+// subtracted from incoming hits.
+func deriveDefense(stats StatsMap) int64 {
+	return (stats["hp_max"] + stats["stamina_max"] + stats["mana_max"]) / 20
+}
+
+func offenseStat(stats StatsMap, style string) int64 {
+	switch style {
+	case "ranged":
+		return stats["ranged"]
+	case "magic":
+		return stats["magic"]
+	default:
+		return stats["melee"]
+	}
+}
+
+func (m *BattleMatch) MatchLeave(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presences []runtime.Presence) interface{} {
+	s := state.(*battleMatchState)
+	for _, presence := range presences {
+		if party, ok := s.parties[presence.GetUserId()]; ok {
+			for _, c := range party.Combatants {
+				c.HP = 0
+			}
+		}
+	}
+	return s
+}
+
+func (m *BattleMatch) MatchLoop(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, messages []runtime.MatchData) interface{} {
+	s := state.(*battleMatchState)
+	if !s.started || s.over {
+		return s
+	}
+
+	actedThisTick := false
+	for _, msg := range messages {
+		if msg.GetOpCode() != OpCodeAction {
+			continue
+		}
+		var action BattleAction
+		if err := json.Unmarshal(msg.GetData(), &action); err != nil {
+			continue
+		}
+		actorKey := combatantKey(msg.GetUserId(), action.UnitInstanceId)
+		if len(s.order) == 0 || s.order[s.turnIdx] != actorKey {
+			continue // not this unit's turn
+		}
+		actor := s.combatant(actorKey)
+		if actor == nil || actor.HP <= 0 {
+			continue
+		}
+
+		switch action.Type {
+		case "attack", "ability":
+			target := s.combatant(combatantKey(targetUserId(s, action.TargetUnitId), action.TargetUnitId))
+			if target == nil || target.HP <= 0 {
+				break
+			}
+			style := action.Style
+			if action.Type == "ability" {
+				style = "magic"
+			}
+			dmg := offenseStat(actor.Stats, style) - deriveDefense(target.Stats)
+			if action.Type == "ability" {
+				dmg += dmg / 2
+			}
+			if target.Defending {
+				dmg /= 2
+			}
+			if dmg < 1 {
+				dmg = 1
+			}
+			target.HP -= dmg
+			if target.HP < 0 {
+				target.HP = 0
+			}
+			actor.DamageDone += dmg
+		case "defend":
+			actor.Defending = true
+		case "end_turn":
+			// no-op, just passes the turn below
+		default:
+			continue
+		}
+		s.advanceTurn()
+		actedThisTick = true
+	}
+
+	if actedThisTick {
+		s.idleTicks = 0
+	} else {
+		s.idleTicks++
+	}
+
+	winner := s.checkWinner()
+	if winner == "" && s.idleTicks >= BattleIdleTickLimit {
+		winner = s.forfeitCurrentTurn()
+	}
+	if winner != "" {
+		s.over = true
+		s.finish(ctx, logger, nk, dispatcher, winner)
+		return nil
+	}
+
+	dispatcher.BroadcastMessage(OpCodeMatchState, s.snapshot(), nil, nil, true)
+	return s
+}
+
+// targetUserId resolves which party owns a given unit instance ID.
+func targetUserId(s *battleMatchState, unitId string) string {
+	for _, party := range s.parties {
+		for _, c := range party.Combatants {
+			if c.UnitId == unitId {
+				return c.UserID
+			}
+		}
+	}
+	return ""
+}
+
+func (s *battleMatchState) checkWinner() string {
+	alive := make([]string, 0, len(s.parties))
+	for userID := range s.parties {
+		if s.partyAlive(userID) {
+			alive = append(alive, userID)
+		}
+	}
+	if len(alive) == 1 {
+		return alive[0]
+	}
+	return ""
+}
+
+// forfeitCurrentTurn wipes out the party whose unit has gone idle past the
+// tick limit and returns the opponent as the winner.
+func (s *battleMatchState) forfeitCurrentTurn() string {
+	if len(s.order) == 0 {
+		return ""
+	}
+	idleUserID := ""
+	if c := s.combatant(s.order[s.turnIdx]); c != nil {
+		idleUserID = c.UserID
+	}
+	for userID, party := range s.parties {
+		if userID == idleUserID {
+			for _, c := range party.Combatants {
+				c.HP = 0
+			}
+		}
+	}
+	return s.checkWinner()
+}
+
+const battleGoldReward = 50
+
+func (s *battleMatchState) finish(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, winnerUserID string) {
+	result := map[string]interface{}{
+		"winnerUserId": winnerUserID,
+		"parties":      s.parties,
+	}
+	resultRaw, _ := json.Marshal(result)
+	dispatcher.BroadcastMessage(OpCodeMatchResult, resultRaw, nil, nil, true)
+
+	for userID, party := range s.parties {
+		var damageDealt int64
+		for _, c := range party.Combatants {
+			damageDealt += c.DamageDone
+		}
+		gold := 0.0
+		if userID == winnerUserID {
+			gold = battleGoldReward
+			if err := txWallet(ctx, nk, userID, func(w *Wallet) error {
+				w.Gold += gold
+				return nil
+			}); err != nil {
+				logger.Error("txWallet battle reward: %v", err)
+			}
+		}
+		entry := map[string]interface{}{
+			"winnerUserId": winnerUserID,
+			"damageDealt":  damageDealt,
+			"goldReward":   gold,
+			"finishedAt":   time.Now().UTC().Format(time.RFC3339),
+		}
+		raw, _ := json.Marshal(entry)
+		if err := writeStorage(ctx, nk, userID, CollectionBattleLog, generateInstanceId(), string(raw)); err != nil {
+			logger.Error("writeStorage battle_log: %v", err)
+		}
+	}
+}
+
+func (m *BattleMatch) MatchTerminate(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, graceSeconds int) interface{} {
+	return state
+}
+
+func (m *BattleMatch) MatchSignal(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, data string) (interface{}, string) {
+	return state, data
+}
+
+// --- RPC: rpc_create_battle ---
+
+type CreateBattlePayload struct {
+	PartyUnitIds []string `json:"partyUnitIds"`
+}
+
+func rpcCreateBattle(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, err := mustGetUserId(ctx)
+	if err != nil {
+		return errResp(CodePermission, "user_id_required")
+	}
+	if payload == "" {
+		return errResp(CodeInvalidArg, "missing_payload")
+	}
+	var in CreateBattlePayload
+	if err := json.Unmarshal([]byte(payload), &in); err != nil {
+		return errResp(CodeInvalidArg, "invalid_json")
+	}
+	if len(in.PartyUnitIds) == 0 {
+		return errResp(CodeInvalidArg, "missing_partyUnitIds")
+	}
+
+	matchId, err := nk.MatchCreate(ctx, BattleMatchModule, map[string]interface{}{
+		"createdBy":    userID,
+		"creatorParty": in.PartyUnitIds,
+	})
+	if err != nil {
+		logger.Error("MatchCreate: %v", err)
+		return errResp(CodeBadRequest, "failed_to_create_match")
+	}
+
+	out := map[string]interface{}{"matchId": matchId}
+	raw, _ := json.Marshal(out)
+	return string(raw), nil
+}
@@ -6,9 +6,23 @@ const (
 	CollectionProfile  = "player/profile"
 	CollectionWallet   = "player/wallet"
 	CollectionInventory = "player/inventory"
+	CollectionIAPReceipts = "player/iap_receipts"
+	CollectionBattleLog = "player/battle_log"
+	CollectionGachaState = "player/gacha_state"
+	CollectionLootboxHistory = "player/lootbox_history"
+	CollectionMarket   = "market/listings"
 	StorageKeyProfile  = "profile"
 	StorageKeyWallet   = "wallet"
 	StorageKeyInventory = "inventory"
+	StorageKeyGachaState = "gacha_state"
+	SystemUserID       = "00000000-0000-0000-0000-000000000000"
+	LeaderboardGoldEarnedFromSales = "gold_earned_from_sales"
+)
+
+const (
+	BattleMatchModule = "battle_match"
+	BattleMaxParties  = 2
+	BattleIdleTickLimit = 200 // ~100s at 2 ticks/sec before an empty side forfeits
 )
 
 var (
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// --- IAP types ---
+
+// IAPReceipt records a single granted purchase transaction for idempotency.
+type IAPReceipt struct {
+	TransactionId string `json:"transactionId"`
+	Store         string `json:"store"`
+	ProductId     string `json:"productId"`
+	GemsGranted   float64 `json:"gemsGranted"`
+	GrantedAt     string `json:"grantedAt"`
+}
+
+var errInsufficientGems = errors.New("insufficient_gems")
+
+func loadIAPCatalog(ctx context.Context) (map[string]float64, error) {
+	env, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	catalog := make(map[string]float64)
+	if env == nil || env["IAP_CATALOG_JSON"] == "" {
+		return catalog, nil
+	}
+	if err := json.Unmarshal([]byte(env["IAP_CATALOG_JSON"]), &catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+func premiumProductId(ctx context.Context) string {
+	env, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	if env == nil {
+		return ""
+	}
+	return env["IAP_PREMIUM_PRODUCT_ID"]
+}
+
+func gemsToGoldRate(ctx context.Context) float64 {
+	env, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	if env == nil {
+		return 10
+	}
+	rate, err := strconv.ParseFloat(env["GEMS_TO_GOLD_RATE"], 64)
+	if err != nil || rate <= 0 {
+		return 10
+	}
+	return rate
+}
+
+// canonicalStoreName normalizes the store identifier to one spelling
+// regardless of which call site produced it: rpc_validate_iap passes the
+// client-supplied short name (e.g. "GooglePlay"), while rpc_restore_purchases
+// passes api.StoreProvider.String() (e.g. "GOOGLE_PLAY_STORE"). Without this,
+// the same purchase restored through the two paths would land under two
+// different receipt keys and lose idempotency.
+func canonicalStoreName(store string) string {
+	switch store {
+	case "GooglePlay", "GOOGLE_PLAY_STORE":
+		return "GooglePlay"
+	case "AppleAppStore", "APPLE_APP_STORE":
+		return "AppleAppStore"
+	case "Huawei", "HUAWEI_APP_GALLERY":
+		return "Huawei"
+	default:
+		return store
+	}
+}
+
+func receiptKey(store, transactionId string) string {
+	return store + ":" + transactionId
+}
+
+func hasReceipt(ctx context.Context, nk runtime.NakamaModule, userID, store, transactionId string) (bool, error) {
+	raw, err := readStorage(ctx, nk, userID, CollectionIAPReceipts, receiptKey(store, transactionId))
+	if err != nil {
+		return false, err
+	}
+	return raw != "", nil
+}
+
+func recordReceipt(ctx context.Context, nk runtime.NakamaModule, userID string, r *IAPReceipt) error {
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return writeStorage(ctx, nk, userID, CollectionIAPReceipts, receiptKey(r.Store, r.TransactionId), string(raw))
+}
+
+// applyValidatedPurchase credits gems (or sets the Premium flag) for a single
+// validated purchase, skipping it if the transaction was already granted.
+func applyValidatedPurchase(ctx context.Context, nk runtime.NakamaModule, userID, store, productId, transactionId string, catalog map[string]float64) (bool, error) {
+	already, err := hasReceipt(ctx, nk, userID, store, transactionId)
+	if err != nil {
+		return false, err
+	}
+	if already {
+		return false, nil
+	}
+
+	profile, _, _, _, err := ensureProfileAndWallet(ctx, nk, userID, "")
+	if err != nil {
+		return false, err
+	}
+
+	gemsGranted := 0.0
+	if productId == premiumProductId(ctx) {
+		profile.Premium = true
+		profileRaw, err := json.Marshal(profile)
+		if err != nil {
+			return false, err
+		}
+		if err := writeStorage(ctx, nk, userID, CollectionProfile, StorageKeyProfile, string(profileRaw)); err != nil {
+			return false, err
+		}
+	} else {
+		gemsGranted = catalog[productId]
+		if err := txWallet(ctx, nk, userID, func(w *Wallet) error {
+			w.Gems += gemsGranted
+			return nil
+		}); err != nil {
+			return false, err
+		}
+	}
+
+	if err := recordReceipt(ctx, nk, userID, &IAPReceipt{
+		TransactionId: transactionId,
+		Store:         store,
+		ProductId:     productId,
+		GemsGranted:   gemsGranted,
+		GrantedAt:     time.Now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// --- RPC: rpc_validate_iap ---
+
+type ValidateIAPPayload struct {
+	Store   string `json:"store"` // GooglePlay | AppleAppStore | Huawei
+	Receipt string `json:"receipt"`
+}
+
+func rpcValidateIAP(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, err := mustGetUserId(ctx)
+	if err != nil {
+		return errResp(CodePermission, "user_id_required")
+	}
+	if payload == "" {
+		return errResp(CodeInvalidArg, "missing_payload")
+	}
+	var in ValidateIAPPayload
+	if err := json.Unmarshal([]byte(payload), &in); err != nil {
+		return errResp(CodeInvalidArg, "invalid_json")
+	}
+	if in.Receipt == "" {
+		return errResp(CodeInvalidArg, "missing_receipt")
+	}
+
+	catalog, err := loadIAPCatalog(ctx)
+	if err != nil {
+		logger.Error("loadIAPCatalog: %v", err)
+		return errResp(CodeBadRequest, "invalid_iap_catalog")
+	}
+
+	var purchases []*api.ValidatedPurchase
+	switch in.Store {
+	case "GooglePlay":
+		resp, err := nk.PurchaseValidateGoogle(ctx, userID, in.Receipt)
+		if err != nil {
+			logger.Error("PurchaseValidateGoogle: %v", err)
+			return errResp(CodeBadRequest, "receipt_validation_failed")
+		}
+		purchases = resp.ValidatedPurchases
+	case "AppleAppStore":
+		resp, err := nk.PurchaseValidateApple(ctx, userID, in.Receipt)
+		if err != nil {
+			logger.Error("PurchaseValidateApple: %v", err)
+			return errResp(CodeBadRequest, "receipt_validation_failed")
+		}
+		purchases = resp.ValidatedPurchases
+	case "Huawei":
+		resp, err := nk.PurchaseValidateHuawei(ctx, userID, in.Receipt)
+		if err != nil {
+			logger.Error("PurchaseValidateHuawei: %v", err)
+			return errResp(CodeBadRequest, "receipt_validation_failed")
+		}
+		purchases = resp.ValidatedPurchases
+	default:
+		return errResp(CodeInvalidArg, "invalid_store")
+	}
+
+	granted := make([]string, 0, len(purchases))
+	for _, p := range purchases {
+		ok, err := applyValidatedPurchase(ctx, nk, userID, canonicalStoreName(in.Store), p.ProductId, p.TransactionId, catalog)
+		if err != nil {
+			logger.Error("applyValidatedPurchase: %v", err)
+			return errResp(CodeBadRequest, "failed_to_grant_purchase")
+		}
+		if ok {
+			granted = append(granted, p.TransactionId)
+		}
+	}
+
+	_, wallet, _, _, err := ensureProfileAndWallet(ctx, nk, userID, "")
+	if err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_wallet")
+	}
+
+	out := map[string]interface{}{
+		"granted": granted,
+		"wallet":  wallet,
+	}
+	raw, _ := json.Marshal(out)
+	return string(raw), nil
+}
+
+// --- RPC: rpc_spend_gems_for_gold ---
+
+type SpendGemsForGoldPayload struct {
+	Gems float64 `json:"gems"`
+}
+
+func rpcSpendGemsForGold(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, err := mustGetUserId(ctx)
+	if err != nil {
+		return errResp(CodePermission, "user_id_required")
+	}
+	if payload == "" {
+		return errResp(CodeInvalidArg, "missing_payload")
+	}
+	var in SpendGemsForGoldPayload
+	if err := json.Unmarshal([]byte(payload), &in); err != nil {
+		return errResp(CodeInvalidArg, "invalid_json")
+	}
+	if in.Gems <= 0 {
+		return errResp(CodeInvalidArg, "gems_must_be_positive")
+	}
+
+	if _, _, _, _, err := ensureProfileAndWallet(ctx, nk, userID, ""); err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_wallet")
+	}
+
+	rate := gemsToGoldRate(ctx)
+	if err := txWallet(ctx, nk, userID, func(w *Wallet) error {
+		if w.Gems < in.Gems {
+			return errInsufficientGems
+		}
+		w.Gems -= in.Gems
+		w.Gold += in.Gems * rate
+		return nil
+	}); err != nil {
+		if err == errInsufficientGems {
+			return errResp(CodeInvalidArg, "insufficient_gems")
+		}
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "wallet_conflict")
+		}
+		return errResp(CodeBadRequest, "failed_to_save_wallet")
+	}
+
+	_, wallet, _, _, err := ensureProfileAndWallet(ctx, nk, userID, "")
+	if err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_wallet")
+	}
+
+	out := map[string]interface{}{"wallet": wallet}
+	outRaw, _ := json.Marshal(out)
+	return string(outRaw), nil
+}
+
+// --- RPC: rpc_restore_purchases ---
+
+func rpcRestorePurchases(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, err := mustGetUserId(ctx)
+	if err != nil {
+		return errResp(CodePermission, "user_id_required")
+	}
+
+	catalog, err := loadIAPCatalog(ctx)
+	if err != nil {
+		logger.Error("loadIAPCatalog: %v", err)
+		return errResp(CodeBadRequest, "invalid_iap_catalog")
+	}
+
+	granted := make([]string, 0)
+	cursor := ""
+	for {
+		list, err := nk.PurchasesList(ctx, userID, 100, cursor)
+		if err != nil {
+			logger.Error("PurchasesList: %v", err)
+			return errResp(CodeBadRequest, "failed_to_list_purchases")
+		}
+		for _, p := range list.ValidatedPurchases {
+			ok, err := applyValidatedPurchase(ctx, nk, userID, canonicalStoreName(p.Store.String()), p.ProductId, p.TransactionId, catalog)
+			if err != nil {
+				logger.Error("applyValidatedPurchase: %v", err)
+				return errResp(CodeBadRequest, "failed_to_restore_purchase")
+			}
+			if ok {
+				granted = append(granted, p.TransactionId)
+			}
+		}
+		if list.Cursor == "" {
+			break
+		}
+		cursor = list.Cursor
+	}
+
+	_, wallet, _, _, err := ensureProfileAndWallet(ctx, nk, userID, "")
+	if err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_wallet")
+	}
+
+	out := map[string]interface{}{
+		"restored": granted,
+		"wallet":   wallet,
+	}
+	raw, _ := json.Marshal(out)
+	return string(raw), nil
+}
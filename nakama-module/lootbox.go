@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+var errInsufficientCurrency = errors.New("insufficient_currency")
+
+// --- Lootbox table definitions (loaded from RUNTIME_CTX_ENV) ---
+
+type BonusRange struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+type LootboxTable struct {
+	Cost            float64                          `json:"cost"`
+	CostCurrency    string                           `json:"costCurrency"` // gold | gems
+	RarityWeights   map[string]float64                `json:"rarityWeights"`
+	SlotWeights     map[string]float64                `json:"slotWeights"`
+	BonusRanges     map[string]map[string]BonusRange   `json:"bonusRanges"` // rarity -> stat -> range
+	BonusCountMin   int                              `json:"bonusCountMin"`
+	BonusCountMax   int                              `json:"bonusCountMax"`
+	PassivePool     []string                         `json:"passivePool,omitempty"`
+	PassiveChance   float64                          `json:"passiveChance"`
+	PityThreshold   int                              `json:"pityThreshold"` // guarantee Epic+ every K opens
+}
+
+func loadLootboxTables(ctx context.Context) (map[string]*LootboxTable, error) {
+	env, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	tables := make(map[string]*LootboxTable)
+	if env == nil || env["LOOTBOX_TABLES_JSON"] == "" {
+		return tables, nil
+	}
+	if err := json.Unmarshal([]byte(env["LOOTBOX_TABLES_JSON"]), &tables); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// --- Per-user gacha pity state ---
+
+type GachaState struct {
+	PityCounters map[string]int `json:"pityCounters"` // boxId -> opens since last Epic+ drop
+}
+
+func loadGachaState(ctx context.Context, nk runtime.NakamaModule, userID string) (*GachaState, error) {
+	raw, err := readStorage(ctx, nk, userID, CollectionGachaState, StorageKeyGachaState)
+	if err != nil {
+		return nil, err
+	}
+	state := &GachaState{PityCounters: make(map[string]int)}
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), state); err != nil {
+			return nil, err
+		}
+		if state.PityCounters == nil {
+			state.PityCounters = make(map[string]int)
+		}
+	}
+	return state, nil
+}
+
+func saveGachaState(ctx context.Context, nk runtime.NakamaModule, userID string, state *GachaState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeStorage(ctx, nk, userID, CollectionGachaState, StorageKeyGachaState, string(raw))
+}
+
+// --- crypto/rand weighted draws ---
+
+func cryptoRandUint64() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func cryptoRandFloat64() (float64, error) {
+	u, err := cryptoRandUint64()
+	if err != nil {
+		return 0, err
+	}
+	return float64(u) / float64(math.MaxUint64), nil
+}
+
+// cryptoRandIntRange returns a uniform random integer in [min, max], inclusive.
+func cryptoRandIntRange(min, max int64) (int64, error) {
+	if max <= min {
+		return min, nil
+	}
+	span := uint64(max-min) + 1
+	u, err := cryptoRandUint64()
+	if err != nil {
+		return 0, err
+	}
+	return min + int64(u%span), nil
+}
+
+// weightedPick normalizes weights into a cumulative distribution and maps a
+// crypto/rand draw into it, in the given key order.
+func weightedPick(order []string, weights map[string]float64) (string, error) {
+	total := 0.0
+	for _, k := range order {
+		total += weights[k]
+	}
+	if total <= 0 {
+		return "", fmt.Errorf("weights sum to zero")
+	}
+	r, err := cryptoRandFloat64()
+	if err != nil {
+		return "", err
+	}
+	target := r * total
+	cum := 0.0
+	for _, k := range order {
+		cum += weights[k]
+		if target < cum {
+			return k, nil
+		}
+	}
+	return order[len(order)-1], nil
+}
+
+func rarityIndex(rarity string) int {
+	for i, r := range AllowedRarities {
+		if r == rarity {
+			return i
+		}
+	}
+	return -1
+}
+
+const epicRarity = "Epic"
+
+// rollBonuses picks 1..N allowed stats and rolls each within the rarity's
+// configured range, reusing validateBonuses to enforce the same contract
+// as the admin grant path.
+func rollBonuses(table *LootboxTable, rarity string) (map[string]int64, error) {
+	ranges := table.BonusRanges[rarity]
+	if len(ranges) == 0 {
+		return map[string]int64{}, nil
+	}
+	allowed := make([]string, 0, len(ranges))
+	for stat := range ranges {
+		if isAllowedStat(stat) {
+			allowed = append(allowed, stat)
+		}
+	}
+	minCount, maxCount := table.BonusCountMin, table.BonusCountMax
+	if minCount <= 0 {
+		minCount = 1
+	}
+	if maxCount < minCount {
+		maxCount = minCount
+	}
+	if maxCount > len(allowed) {
+		maxCount = len(allowed)
+	}
+	if minCount > maxCount {
+		// allowed can be shorter than bonusCountMin if the table's
+		// bonusRanges reference stats outside AllowedStats; without this,
+		// cryptoRandIntRange(0, len(allowed)-1) below indexes an empty slice.
+		minCount = maxCount
+	}
+	count, err := cryptoRandIntRange(int64(minCount), int64(maxCount))
+	if err != nil {
+		return nil, err
+	}
+
+	bonuses := make(map[string]int64)
+	for len(bonuses) < int(count) {
+		idx, err := cryptoRandIntRange(0, int64(len(allowed)-1))
+		if err != nil {
+			return nil, err
+		}
+		stat := allowed[idx]
+		if _, picked := bonuses[stat]; picked {
+			continue
+		}
+		rng := ranges[stat]
+		val, err := cryptoRandIntRange(rng.Min, rng.Max)
+		if err != nil {
+			return nil, err
+		}
+		bonuses[stat] = val
+	}
+	if err := validateBonuses(bonuses); err != nil {
+		return nil, err
+	}
+	return bonuses, nil
+}
+
+// --- RPC: rpc_open_lootbox ---
+
+type OpenLootboxPayload struct {
+	BoxId string `json:"boxId"`
+}
+
+func rpcOpenLootbox(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, err := mustGetUserId(ctx)
+	if err != nil {
+		return errResp(CodePermission, "user_id_required")
+	}
+	if payload == "" {
+		return errResp(CodeInvalidArg, "missing_payload")
+	}
+	var in OpenLootboxPayload
+	if err := json.Unmarshal([]byte(payload), &in); err != nil {
+		return errResp(CodeInvalidArg, "invalid_json")
+	}
+	if in.BoxId == "" {
+		return errResp(CodeInvalidArg, "missing_boxId")
+	}
+
+	tables, err := loadLootboxTables(ctx)
+	if err != nil {
+		logger.Error("loadLootboxTables: %v", err)
+		return errResp(CodeBadRequest, "invalid_lootbox_tables")
+	}
+	table, ok := tables[in.BoxId]
+	if !ok {
+		return errResp(CodeNotFound, "box_not_found")
+	}
+
+	_, wallet, _, _, err := ensureProfileAndWallet(ctx, nk, userID, "")
+	if err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_wallet")
+	}
+	switch table.CostCurrency {
+	case "gems":
+		if wallet.Gems < table.Cost {
+			return errResp(CodeInvalidArg, "insufficient_gems")
+		}
+	default:
+		if wallet.Gold < table.Cost {
+			return errResp(CodeInvalidArg, "insufficient_gold")
+		}
+	}
+
+	gachaState, err := loadGachaState(ctx, nk, userID)
+	if err != nil {
+		logger.Error("loadGachaState: %v", err)
+		return errResp(CodeBadRequest, "failed_to_load_gacha_state")
+	}
+
+	rarity, err := weightedPick(AllowedRarities[:], table.RarityWeights)
+	if err != nil {
+		logger.Error("weightedPick rarity: %v", err)
+		return errResp(CodeBadRequest, "invalid_rarity_weights")
+	}
+	pityCount := gachaState.PityCounters[in.BoxId]
+	if table.PityThreshold > 0 && rarityIndex(rarity) < rarityIndex(epicRarity) && pityCount+1 >= table.PityThreshold {
+		rarity = epicRarity
+	}
+	if rarityIndex(rarity) >= rarityIndex(epicRarity) {
+		gachaState.PityCounters[in.BoxId] = 0
+	} else {
+		gachaState.PityCounters[in.BoxId] = pityCount + 1
+	}
+
+	slot, err := weightedPick(AllowedSlots[:], table.SlotWeights)
+	if err != nil {
+		logger.Error("weightedPick slot: %v", err)
+		return errResp(CodeBadRequest, "invalid_slot_weights")
+	}
+
+	bonuses, err := rollBonuses(table, rarity)
+	if err != nil {
+		logger.Error("rollBonuses: %v", err)
+		return errResp(CodeBadRequest, "invalid_bonus_ranges")
+	}
+
+	passive := ""
+	if len(table.PassivePool) > 0 {
+		roll, err := cryptoRandFloat64()
+		if err != nil {
+			return errResp(CodeBadRequest, "failed_to_roll_passive")
+		}
+		if roll < table.PassiveChance {
+			idx, err := cryptoRandIntRange(0, int64(len(table.PassivePool)-1))
+			if err != nil {
+				return errResp(CodeBadRequest, "failed_to_roll_passive")
+			}
+			passive = table.PassivePool[idx]
+		}
+	}
+
+	instanceId := generateInstanceId()
+	item := &ItemInstance{
+		InstanceId: instanceId,
+		TemplateId: in.BoxId,
+		Rarity:     rarity,
+		Slot:       slot,
+		Bonuses:    bonuses,
+		Passive:    passive,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := txWallet(ctx, nk, userID, func(w *Wallet) error {
+		switch table.CostCurrency {
+		case "gems":
+			if w.Gems < table.Cost {
+				return errInsufficientCurrency
+			}
+			w.Gems -= table.Cost
+		default:
+			if w.Gold < table.Cost {
+				return errInsufficientCurrency
+			}
+			w.Gold -= table.Cost
+		}
+		return nil
+	}); err != nil {
+		if err == errInsufficientCurrency {
+			if table.CostCurrency == "gems" {
+				return errResp(CodeInvalidArg, "insufficient_gems")
+			}
+			return errResp(CodeInvalidArg, "insufficient_gold")
+		}
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "wallet_conflict")
+		}
+		return errResp(CodeBadRequest, "failed_to_save_wallet")
+	}
+
+	if err := txInventory(ctx, nk, userID, func(inv *Inventory) error {
+		inv.Items[instanceId] = item
+		return nil
+	}); err != nil {
+		// The box was paid for but never granted - refund it rather than
+		// leaving the cost charged with nothing to show for it.
+		if refundErr := txWallet(ctx, nk, userID, func(w *Wallet) error {
+			if table.CostCurrency == "gems" {
+				w.Gems += table.Cost
+			} else {
+				w.Gold += table.Cost
+			}
+			return nil
+		}); refundErr != nil {
+			logger.Error("txWallet refund: %v", refundErr)
+		}
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "inventory_conflict")
+		}
+		return errResp(CodeBadRequest, "failed_to_save_item")
+	}
+	if err := saveGachaState(ctx, nk, userID, gachaState); err != nil {
+		logger.Error("saveGachaState: %v", err)
+		return errResp(CodeBadRequest, "failed_to_save_gacha_state")
+	}
+
+	_, wallet, _, _, err = ensureProfileAndWallet(ctx, nk, userID, "")
+	if err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_wallet")
+	}
+
+	historyEntry := map[string]interface{}{
+		"boxId":     in.BoxId,
+		"item":      item,
+		"cost":      table.Cost,
+		"currency":  table.CostCurrency,
+		"pityCount": gachaState.PityCounters[in.BoxId],
+		"openedAt":  item.CreatedAt,
+	}
+	historyRaw, _ := json.Marshal(historyEntry)
+	if err := writeStorage(ctx, nk, userID, CollectionLootboxHistory, generateInstanceId(), string(historyRaw)); err != nil {
+		logger.Error("writeStorage lootbox_history: %v", err)
+	}
+
+	out := map[string]interface{}{"item": item, "wallet": wallet}
+	raw, _ := json.Marshal(out)
+	return string(raw), nil
+}
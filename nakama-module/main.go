@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/heroiclabs/nakama-common/runtime"
@@ -18,10 +19,12 @@ import (
 type Profile struct {
 	Username  string `json:"username"`
 	CreatedAt string `json:"createdAt"`
+	Premium   bool   `json:"premium"`
 }
 
 type Wallet struct {
 	Gold float64 `json:"gold"`
+	Gems float64 `json:"gems"`
 }
 
 type StatsMap map[string]int64
@@ -63,6 +66,7 @@ const (
 	CodeNotFound     = 5
 	CodePermission   = 7
 	CodeInvalidArg   = 3
+	CodeConflict     = 10
 )
 
 func errResp(code int, msg string) (string, error) {
@@ -119,10 +123,9 @@ func writeStorage(ctx context.Context, nk runtime.NakamaModule, userID, collecti
 	return err
 }
 
-func ensureProfileAndWallet(ctx context.Context, nk runtime.NakamaModule, userID, username string) (*Profile, *Wallet, *Inventory, error) {
+func ensureProfileAndWallet(ctx context.Context, nk runtime.NakamaModule, userID, username string) (*Profile, *Wallet, *Inventory, string, error) {
 	profileJSON, _ := readStorage(ctx, nk, userID, CollectionProfile, StorageKeyProfile)
 	walletJSON, _ := readStorage(ctx, nk, userID, CollectionWallet, StorageKeyWallet)
-	inventoryJSON, _ := readStorage(ctx, nk, userID, CollectionInventory, StorageKeyInventory)
 
 	var profile Profile
 	if profileJSON == "" {
@@ -136,11 +139,11 @@ func ensureProfileAndWallet(ctx context.Context, nk runtime.NakamaModule, userID
 		}
 		raw, _ := json.Marshal(profile)
 		if err := writeStorage(ctx, nk, userID, CollectionProfile, StorageKeyProfile, string(raw)); err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, "", err
 		}
 	} else {
 		if err := json.Unmarshal([]byte(profileJSON), &profile); err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, "", err
 		}
 	}
 
@@ -149,27 +152,186 @@ func ensureProfileAndWallet(ctx context.Context, nk runtime.NakamaModule, userID
 		wallet = Wallet{Gold: 0}
 		raw, _ := json.Marshal(wallet)
 		if err := writeStorage(ctx, nk, userID, CollectionWallet, StorageKeyWallet, string(raw)); err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, "", err
 		}
 	} else {
 		if err := json.Unmarshal([]byte(walletJSON), &wallet); err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, "", err
 		}
 	}
 
+	inv, invVersion, err := loadInventoryWithVersion(ctx, nk, userID)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	return &profile, &wallet, inv, invVersion, nil
+}
+
+// loadInventoryWithVersion reads a user's inventory together with its
+// current storage version, for use with optimistic-concurrency writes.
+func loadInventoryWithVersion(ctx context.Context, nk runtime.NakamaModule, userID string) (*Inventory, string, error) {
+	reads := []*runtime.StorageRead{
+		{
+			Collection: CollectionInventory,
+			Key:       StorageKeyInventory,
+			UserID:    userID,
+		},
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, "", err
+	}
 	inv := initInventory()
-	if inventoryJSON != "" {
-		if err := json.Unmarshal([]byte(inventoryJSON), inv); err != nil {
-			return nil, nil, nil, err
+	if len(objects) == 0 {
+		return inv, "", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), inv); err != nil {
+		return nil, "", err
+	}
+	if inv.Items == nil {
+		inv.Items = make(map[string]*ItemInstance)
+	}
+	if inv.Units == nil {
+		inv.Units = make(map[string]*UnitInstance)
+	}
+	return inv, objects[0].Version, nil
+}
+
+var inventoryLocks sync.Map // userID -> *sync.Mutex
+
+func inventoryMutex(userID string) *sync.Mutex {
+	v, _ := inventoryLocks.LoadOrStore(userID, &sync.Mutex{})
+	return v.(*sync.Mutex)
+}
+
+const maxInventoryTxRetries = 3
+
+// txInventory is the read-modify-write contract every mutating RPC must use
+// to touch a user's inventory. It loads the current version, applies fn,
+// and writes back with that version so a concurrent writer's change is
+// never silently lost; a CAS conflict retries the whole cycle. A per-user
+// mutex additionally serializes same-user calls on this node so the
+// retry isn't needed for the common case of two RPCs racing locally.
+func txInventory(ctx context.Context, nk runtime.NakamaModule, userID string, fn func(inv *Inventory) error) error {
+	mu := inventoryMutex(userID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var lastErr error
+	for attempt := 0; attempt < maxInventoryTxRetries; attempt++ {
+		inv, version, err := loadInventoryWithVersion(ctx, nk, userID)
+		if err != nil {
+			return err
+		}
+		if err := fn(inv); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(inv)
+		if err != nil {
+			return err
+		}
+		writeVersion := version
+		if writeVersion == "" {
+			writeVersion = "*"
+		}
+		writes := []*runtime.StorageWrite{
+			{
+				Collection:      CollectionInventory,
+				Key:             StorageKeyInventory,
+				UserID:          userID,
+				Value:           string(raw),
+				Version:         writeVersion,
+				PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+				PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			},
+		}
+		if _, err := nk.StorageWrite(ctx, writes); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return runtime.NewError(fmt.Sprintf("inventory_conflict: %v", lastErr), CodeConflict)
+}
+
+// loadWalletWithVersion reads a user's wallet together with its current
+// storage version, for use with optimistic-concurrency writes.
+func loadWalletWithVersion(ctx context.Context, nk runtime.NakamaModule, userID string) (*Wallet, string, error) {
+	reads := []*runtime.StorageRead{
+		{
+			Collection: CollectionWallet,
+			Key:        StorageKeyWallet,
+			UserID:     userID,
+		},
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, "", err
+	}
+	wallet := &Wallet{}
+	if len(objects) == 0 {
+		return wallet, "", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), wallet); err != nil {
+		return nil, "", err
+	}
+	return wallet, objects[0].Version, nil
+}
+
+var walletLocks sync.Map // userID -> *sync.Mutex
+
+func walletMutex(userID string) *sync.Mutex {
+	v, _ := walletLocks.LoadOrStore(userID, &sync.Mutex{})
+	return v.(*sync.Mutex)
+}
+
+const maxWalletTxRetries = 3
+
+// txWallet is the wallet analogue of txInventory: any RPC that debits or
+// credits gold/gems outside of a brand-new account's initial creation
+// (ensureProfileAndWallet) must go through this instead of a blind
+// writeStorage, so two concurrent spends on the same wallet can't silently
+// clobber each other.
+func txWallet(ctx context.Context, nk runtime.NakamaModule, userID string, fn func(w *Wallet) error) error {
+	mu := walletMutex(userID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var lastErr error
+	for attempt := 0; attempt < maxWalletTxRetries; attempt++ {
+		wallet, version, err := loadWalletWithVersion(ctx, nk, userID)
+		if err != nil {
+			return err
+		}
+		if err := fn(wallet); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(wallet)
+		if err != nil {
+			return err
+		}
+		writeVersion := version
+		if writeVersion == "" {
+			writeVersion = "*"
 		}
-		if inv.Items == nil {
-			inv.Items = make(map[string]*ItemInstance)
+		writes := []*runtime.StorageWrite{
+			{
+				Collection:      CollectionWallet,
+				Key:             StorageKeyWallet,
+				UserID:          userID,
+				Value:           string(raw),
+				Version:         writeVersion,
+				PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+				PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			},
 		}
-		if inv.Units == nil {
-			inv.Units = make(map[string]*UnitInstance)
+		if _, err := nk.StorageWrite(ctx, writes); err != nil {
+			lastErr = err
+			continue
 		}
+		return nil
 	}
-	return &profile, &wallet, inv, nil
+	return runtime.NewError(fmt.Sprintf("wallet_conflict: %v", lastErr), CodeConflict)
 }
 
 // --- Validation ---
@@ -201,6 +363,36 @@ func validateBonuses(bonuses map[string]int64) error {
 	return nil
 }
 
+// computeFinalStats returns a unit's base + equipped-item-bonus stats.
+// Shared by rpcComputeFinalStats and the battle match handler so both
+// agree on exactly how a unit's combat stats are derived.
+func computeFinalStats(inv *Inventory, unitId string) (*UnitInstance, StatsMap, error) {
+	unit, ok := inv.Units[unitId]
+	if !ok {
+		return nil, nil, fmt.Errorf("unit_not_found")
+	}
+
+	final := make(StatsMap)
+	for _, k := range AllowedStats {
+		final[k] = unit.Stats[k]
+	}
+	for _, itemId := range unit.Equipment {
+		if itemId == "" {
+			continue
+		}
+		item, ok := inv.Items[itemId]
+		if !ok {
+			continue
+		}
+		for k, v := range item.Bonuses {
+			if isAllowedStat(k) {
+				final[k] += v
+			}
+		}
+	}
+	return unit, final, nil
+}
+
 // --- RPC: rpc_get_state ---
 
 func rpcGetState(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
@@ -209,7 +401,7 @@ func rpcGetState(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runt
 		return errResp(CodePermission, "user_id_required")
 	}
 	username, _ := ctx.Value(runtime.RUNTIME_CTX_USERNAME).(string)
-	profile, wallet, inv, err := ensureProfileAndWallet(ctx, nk, userID, username)
+	profile, wallet, inv, _, err := ensureProfileAndWallet(ctx, nk, userID, username)
 	if err != nil {
 		logger.Error("ensureProfileAndWallet: %v", err)
 		return errResp(CodeBadRequest, "failed_to_load_state")
@@ -263,8 +455,7 @@ func rpcCreateUnit(ctx context.Context, logger runtime.Logger, db *sql.DB, nk ru
 		return errResp(CodeInvalidArg, err.Error())
 	}
 
-	_, _, inv, err := ensureProfileAndWallet(ctx, nk, userID, "")
-	if err != nil {
+	if _, _, _, _, err := ensureProfileAndWallet(ctx, nk, userID, ""); err != nil {
 		return errResp(CodeBadRequest, "failed_to_load_inventory")
 	}
 
@@ -276,10 +467,14 @@ func rpcCreateUnit(ctx context.Context, logger runtime.Logger, db *sql.DB, nk ru
 		Stats:      in.Stats,
 		Equipment:  map[string]string{"weapon": "", "armor": "", "relic": ""},
 	}
-	inv.Units[instanceId] = unit
-
-	invRaw, _ := json.Marshal(inv)
-	if err := writeStorage(ctx, nk, userID, CollectionInventory, StorageKeyInventory, string(invRaw)); err != nil {
+	err = txInventory(ctx, nk, userID, func(inv *Inventory) error {
+		inv.Units[instanceId] = unit
+		return nil
+	})
+	if err != nil {
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "inventory_conflict")
+		}
 		return errResp(CodeBadRequest, "failed_to_save_unit")
 	}
 
@@ -331,8 +526,7 @@ func rpcGrantItem(ctx context.Context, logger runtime.Logger, db *sql.DB, nk run
 		return errResp(CodeInvalidArg, err.Error())
 	}
 
-	_, _, inv, err := ensureProfileAndWallet(ctx, nk, targetUserID, "")
-	if err != nil {
+	if _, _, _, _, err := ensureProfileAndWallet(ctx, nk, targetUserID, ""); err != nil {
 		return errResp(CodeBadRequest, "failed_to_load_inventory")
 	}
 
@@ -349,10 +543,14 @@ func rpcGrantItem(ctx context.Context, logger runtime.Logger, db *sql.DB, nk run
 	if item.Bonuses == nil {
 		item.Bonuses = make(map[string]int64)
 	}
-	inv.Items[instanceId] = item
-
-	invRaw, _ := json.Marshal(inv)
-	if err := writeStorage(ctx, nk, targetUserID, CollectionInventory, StorageKeyInventory, string(invRaw)); err != nil {
+	err := txInventory(ctx, nk, targetUserID, func(inv *Inventory) error {
+		inv.Items[instanceId] = item
+		return nil
+	})
+	if err != nil {
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "inventory_conflict")
+		}
 		return errResp(CodeBadRequest, "failed_to_save_item")
 	}
 
@@ -388,43 +586,60 @@ func rpcEquipItem(ctx context.Context, logger runtime.Logger, db *sql.DB, nk run
 		return errResp(CodeInvalidArg, "slotName must be weapon, armor, or relic")
 	}
 
-	_, _, inv, err := ensureProfileAndWallet(ctx, nk, userID, "")
-	if err != nil {
+	if _, _, _, _, err := ensureProfileAndWallet(ctx, nk, userID, ""); err != nil {
 		return errResp(CodeBadRequest, "failed_to_load_inventory")
 	}
 
-	unit, ok := inv.Units[in.UnitInstanceId]
-	if !ok {
-		return errResp(CodeNotFound, "unit_not_found")
-	}
-
 	var itemInstanceId string
 	if in.ItemInstanceId != nil {
 		itemInstanceId = *in.ItemInstanceId
 	}
-	if itemInstanceId != "" {
-		item, ok := inv.Items[itemInstanceId]
+
+	var resultUnit *UnitInstance
+	var applyErr error
+	err = txInventory(ctx, nk, userID, func(inv *Inventory) error {
+		unit, ok := inv.Units[in.UnitInstanceId]
 		if !ok {
-			return errResp(CodeNotFound, "item_not_found")
+			applyErr = errors.New("unit_not_found")
+			return applyErr
 		}
-		// Contract: slotName is weapon|armor|relic; item.Slot is Weapon|Armor|Relic
-		slotMatch := (in.SlotName == "weapon" && item.Slot == "Weapon") ||
-			(in.SlotName == "armor" && item.Slot == "Armor") ||
-			(in.SlotName == "relic" && item.Slot == "Relic")
-		if !slotMatch {
-			return errResp(CodeInvalidArg, "item_slot_mismatch")
+		if itemInstanceId != "" {
+			item, ok := inv.Items[itemInstanceId]
+			if !ok {
+				applyErr = errors.New("item_not_found")
+				return applyErr
+			}
+			// Contract: slotName is weapon|armor|relic; item.Slot is Weapon|Armor|Relic
+			slotMatch := (in.SlotName == "weapon" && item.Slot == "Weapon") ||
+				(in.SlotName == "armor" && item.Slot == "Armor") ||
+				(in.SlotName == "relic" && item.Slot == "Relic")
+			if !slotMatch {
+				applyErr = errors.New("item_slot_mismatch")
+				return applyErr
+			}
+			unit.Equipment[in.SlotName] = itemInstanceId
+		} else {
+			unit.Equipment[in.SlotName] = ""
+		}
+		resultUnit = unit
+		return nil
+	})
+	if applyErr != nil {
+		switch applyErr.Error() {
+		case "unit_not_found", "item_not_found":
+			return errResp(CodeNotFound, applyErr.Error())
+		default:
+			return errResp(CodeInvalidArg, applyErr.Error())
 		}
-		unit.Equipment[in.SlotName] = itemInstanceId
-	} else {
-		unit.Equipment[in.SlotName] = ""
 	}
-
-	invRaw, _ := json.Marshal(inv)
-	if err := writeStorage(ctx, nk, userID, CollectionInventory, StorageKeyInventory, string(invRaw)); err != nil {
+	if err != nil {
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "inventory_conflict")
+		}
 		return errResp(CodeBadRequest, "failed_to_save_equipment")
 	}
 
-	out := map[string]interface{}{"unit": unit}
+	out := map[string]interface{}{"unit": resultUnit}
 	raw, _ := json.Marshal(out)
 	return string(raw), nil
 }
@@ -451,36 +666,16 @@ func rpcComputeFinalStats(ctx context.Context, logger runtime.Logger, db *sql.DB
 		return errResp(CodeInvalidArg, "missing_unitInstanceId")
 	}
 
-	_, _, inv, err := ensureProfileAndWallet(ctx, nk, userID, "")
+	_, _, inv, _, err := ensureProfileAndWallet(ctx, nk, userID, "")
 	if err != nil {
 		return errResp(CodeBadRequest, "failed_to_load_inventory")
 	}
 
-	unit, ok := inv.Units[in.UnitInstanceId]
-	if !ok {
+	unit, final, err := computeFinalStats(inv, in.UnitInstanceId)
+	if err != nil {
 		return errResp(CodeNotFound, "unit_not_found")
 	}
 
-	// base + sum of equipped item bonuses
-	final := make(StatsMap)
-	for _, k := range AllowedStats {
-		final[k] = unit.Stats[k]
-	}
-	for _, itemId := range unit.Equipment {
-		if itemId == "" {
-			continue
-		}
-		item, ok := inv.Items[itemId]
-		if !ok {
-			continue
-		}
-		for k, v := range item.Bonuses {
-			if isAllowedStat(k) {
-				final[k] += v
-			}
-		}
-	}
-
 	out := map[string]interface{}{
 		"unitInstanceId": in.UnitInstanceId,
 		"baseStats":      unit.Stats,
@@ -508,6 +703,41 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 	if err := initializer.RegisterRpc("rpc_compute_final_stats", rpcComputeFinalStats); err != nil {
 		return err
 	}
+	if err := initializer.RegisterRpc("rpc_validate_iap", rpcValidateIAP); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_spend_gems_for_gold", rpcSpendGemsForGold); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_restore_purchases", rpcRestorePurchases); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_create_battle", rpcCreateBattle); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_open_lootbox", rpcOpenLootbox); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_list_item", rpcListItem); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_browse_listings", rpcBrowseListings); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_buy_listing", rpcBuyListing); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_cancel_listing", rpcCancelListing); err != nil {
+		return err
+	}
+	if err := initializer.RegisterMatch(BattleMatchModule, func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule) (runtime.Match, error) {
+		return &BattleMatch{}, nil
+	}); err != nil {
+		return err
+	}
+	if err := nk.LeaderboardCreate(ctx, LeaderboardGoldEarnedFromSales, true, "desc", "incr", "", nil, false); err != nil {
+		return err
+	}
 	logger.Info("game module loaded")
 	return nil
 }
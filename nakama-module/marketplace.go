@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// --- Marketplace types ---
+
+type MarketListing struct {
+	ListingId    string        `json:"listingId"`
+	SellerUserId string        `json:"sellerUserId"`
+	Item         *ItemInstance `json:"item"`
+	PriceGold    float64       `json:"priceGold"`
+	CreatedAt    string        `json:"createdAt"`
+}
+
+func marketListingKey(listingId string) string {
+	return "listing:" + listingId
+}
+
+var errInsufficientGold = errors.New("insufficient_gold")
+
+func marketTaxRate(ctx context.Context) float64 {
+	env, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	if env == nil {
+		return 0.05
+	}
+	rate, err := strconv.ParseFloat(env["MARKET_TAX_RATE"], 64)
+	if err != nil || rate < 0 || rate >= 1 {
+		return 0.05
+	}
+	return rate
+}
+
+// readListingWithVersion reads a listing together with its current storage
+// version, so a caller can claim it with a version-gated delete afterwards.
+func readListingWithVersion(ctx context.Context, nk runtime.NakamaModule, listingId string) (*MarketListing, string, error) {
+	reads := []*runtime.StorageRead{
+		{
+			Collection: CollectionMarket,
+			Key:        marketListingKey(listingId),
+			UserID:     SystemUserID,
+		},
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	var listing MarketListing
+	if err := json.Unmarshal([]byte(objects[0].Value), &listing); err != nil {
+		return nil, "", err
+	}
+	return &listing, objects[0].Version, nil
+}
+
+// claimListing removes a listing with a version-gated delete. Only the
+// caller holding the version it was read with can win the delete, so two
+// concurrent buyers (or a buyer racing a cancel) can't both act on the same
+// listing.
+func claimListing(ctx context.Context, nk runtime.NakamaModule, listingId, version string) error {
+	deletes := []*runtime.StorageDelete{
+		{
+			Collection: CollectionMarket,
+			Key:        marketListingKey(listingId),
+			UserID:     SystemUserID,
+			Version:    version,
+		},
+	}
+	return nk.StorageDelete(ctx, deletes)
+}
+
+// restoreListing recreates a listing that was already claimed once a later
+// step fails, so a claim that didn't actually complete the sale doesn't
+// leave the item stranded off the market.
+func restoreListing(ctx context.Context, nk runtime.NakamaModule, listing *MarketListing) error {
+	raw, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+	writes := []*runtime.StorageWrite{
+		{
+			Collection:      CollectionMarket,
+			Key:             marketListingKey(listing.ListingId),
+			UserID:          SystemUserID,
+			Value:           string(raw),
+			Version:         "*",
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+		},
+	}
+	_, err = nk.StorageWrite(ctx, writes)
+	return err
+}
+
+// --- RPC: rpc_list_item ---
+
+type ListItemPayload struct {
+	ItemInstanceId string  `json:"itemInstanceId"`
+	PriceGold      float64 `json:"priceGold"`
+}
+
+func rpcListItem(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, err := mustGetUserId(ctx)
+	if err != nil {
+		return errResp(CodePermission, "user_id_required")
+	}
+	if payload == "" {
+		return errResp(CodeInvalidArg, "missing_payload")
+	}
+	var in ListItemPayload
+	if err := json.Unmarshal([]byte(payload), &in); err != nil {
+		return errResp(CodeInvalidArg, "invalid_json")
+	}
+	if in.ItemInstanceId == "" || in.PriceGold <= 0 {
+		return errResp(CodeInvalidArg, "missing_itemInstanceId_or_invalid_priceGold")
+	}
+
+	inv, _, err := loadInventoryWithVersion(ctx, nk, userID)
+	if err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_inventory")
+	}
+	item, ok := inv.Items[in.ItemInstanceId]
+	if !ok {
+		return errResp(CodeNotFound, "item_not_found")
+	}
+	for _, unit := range inv.Units {
+		for _, equippedId := range unit.Equipment {
+			if equippedId == in.ItemInstanceId {
+				return errResp(CodeInvalidArg, "item_equipped")
+			}
+		}
+	}
+
+	listing := &MarketListing{
+		ListingId:    generateInstanceId(),
+		SellerUserId: userID,
+		Item:         item,
+		PriceGold:    in.PriceGold,
+		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	raw, _ := json.Marshal(listing)
+	writes := []*runtime.StorageWrite{
+		{
+			Collection:      CollectionMarket,
+			Key:             marketListingKey(listing.ListingId),
+			UserID:          SystemUserID,
+			Value:           string(raw),
+			Version:         "*",
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+		},
+	}
+	acks, err := nk.StorageWrite(ctx, writes)
+	if err != nil {
+		logger.Error("StorageWrite listing: %v", err)
+		return errResp(CodeBadRequest, "failed_to_create_listing")
+	}
+	listingVersion := ""
+	if len(acks) > 0 {
+		listingVersion = acks[0].Version
+	}
+
+	// The listing exists before the item leaves the seller's inventory: if
+	// the escrow write below fails or the item changed underneath us, roll
+	// the listing back instead of leaving it live with no backing item.
+	var applyErr error
+	err = txInventory(ctx, nk, userID, func(inv *Inventory) error {
+		found, ok := inv.Items[in.ItemInstanceId]
+		if !ok {
+			applyErr = errors.New("item_not_found")
+			return applyErr
+		}
+		for _, unit := range inv.Units {
+			for _, equippedId := range unit.Equipment {
+				if equippedId == in.ItemInstanceId {
+					applyErr = errors.New("item_equipped")
+					return applyErr
+				}
+			}
+		}
+		delete(inv.Items, in.ItemInstanceId)
+		return nil
+	})
+	if applyErr != nil || err != nil {
+		if delErr := claimListing(ctx, nk, listing.ListingId, listingVersion); delErr != nil {
+			logger.Error("claimListing rollback: %v", delErr)
+		}
+	}
+	if applyErr != nil {
+		if applyErr.Error() == "item_not_found" {
+			return errResp(CodeNotFound, applyErr.Error())
+		}
+		return errResp(CodeInvalidArg, applyErr.Error())
+	}
+	if err != nil {
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "inventory_conflict")
+		}
+		return errResp(CodeBadRequest, "failed_to_escrow_item")
+	}
+
+	out := map[string]interface{}{"listing": listing}
+	outRaw, _ := json.Marshal(out)
+	return string(outRaw), nil
+}
+
+// --- RPC: rpc_browse_listings ---
+
+type BrowseListingsPayload struct {
+	Rarity       string  `json:"rarity,omitempty"`
+	Slot         string  `json:"slot,omitempty"`
+	MaxPriceGold float64 `json:"maxPriceGold,omitempty"`
+	Limit        int     `json:"limit,omitempty"`
+	Cursor       string  `json:"cursor,omitempty"`
+}
+
+func rpcBrowseListings(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var in BrowseListingsPayload
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &in); err != nil {
+			return errResp(CodeInvalidArg, "invalid_json")
+		}
+	}
+	limit := in.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 25
+	}
+
+	objects, cursor, err := nk.StorageList(ctx, "", SystemUserID, CollectionMarket, limit, in.Cursor)
+	if err != nil {
+		logger.Error("StorageList listings: %v", err)
+		return errResp(CodeBadRequest, "failed_to_list_listings")
+	}
+
+	listings := make([]*MarketListing, 0, len(objects))
+	for _, obj := range objects {
+		var listing MarketListing
+		if err := json.Unmarshal([]byte(obj.Value), &listing); err != nil {
+			continue
+		}
+		if in.Rarity != "" && listing.Item.Rarity != in.Rarity {
+			continue
+		}
+		if in.Slot != "" && listing.Item.Slot != in.Slot {
+			continue
+		}
+		if in.MaxPriceGold > 0 && listing.PriceGold > in.MaxPriceGold {
+			continue
+		}
+		listings = append(listings, &listing)
+	}
+
+	out := map[string]interface{}{"listings": listings, "cursor": cursor}
+	raw, _ := json.Marshal(out)
+	return string(raw), nil
+}
+
+// --- RPC: rpc_buy_listing ---
+
+type BuyListingPayload struct {
+	ListingId string `json:"listingId"`
+}
+
+func rpcBuyListing(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	buyerID, err := mustGetUserId(ctx)
+	if err != nil {
+		return errResp(CodePermission, "user_id_required")
+	}
+	if payload == "" {
+		return errResp(CodeInvalidArg, "missing_payload")
+	}
+	var in BuyListingPayload
+	if err := json.Unmarshal([]byte(payload), &in); err != nil {
+		return errResp(CodeInvalidArg, "invalid_json")
+	}
+	if in.ListingId == "" {
+		return errResp(CodeInvalidArg, "missing_listingId")
+	}
+
+	listing, version, err := readListingWithVersion(ctx, nk, in.ListingId)
+	if err != nil {
+		logger.Error("readListingWithVersion: %v", err)
+		return errResp(CodeBadRequest, "failed_to_load_listing")
+	}
+	if listing == nil {
+		return errResp(CodeNotFound, "listing_not_found")
+	}
+	if listing.SellerUserId == buyerID {
+		return errResp(CodeInvalidArg, "cannot_buy_own_listing")
+	}
+
+	_, buyerWallet, _, _, err := ensureProfileAndWallet(ctx, nk, buyerID, "")
+	if err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_wallet")
+	}
+	if buyerWallet.Gold < listing.PriceGold {
+		return errResp(CodeInvalidArg, "insufficient_gold")
+	}
+	if _, _, _, _, err := ensureProfileAndWallet(ctx, nk, listing.SellerUserId, ""); err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_seller_wallet")
+	}
+
+	// Claim the listing with a version-gated delete before any gold or item
+	// moves. This is the only point where two concurrent buyers can compete,
+	// and only one delete can win against the version we just read - closing
+	// the window where both would otherwise pass the checks above and both
+	// pay out for the same listing.
+	if err := claimListing(ctx, nk, in.ListingId, version); err != nil {
+		return errResp(CodeConflict, "listing_already_sold")
+	}
+
+	tax := marketTaxRate(ctx)
+	proceeds := listing.PriceGold * (1 - tax)
+
+	if err := txWallet(ctx, nk, buyerID, func(w *Wallet) error {
+		if w.Gold < listing.PriceGold {
+			return errInsufficientGold
+		}
+		w.Gold -= listing.PriceGold
+		return nil
+	}); err != nil {
+		// The listing is already claimed - recreate it so the item isn't lost.
+		if restoreErr := restoreListing(ctx, nk, listing); restoreErr != nil {
+			logger.Error("restoreListing after failed charge: %v", restoreErr)
+		}
+		if err == errInsufficientGold {
+			return errResp(CodeInvalidArg, "insufficient_gold")
+		}
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "wallet_conflict")
+		}
+		return errResp(CodeBadRequest, "failed_to_charge_buyer")
+	}
+
+	if err := txWallet(ctx, nk, listing.SellerUserId, func(w *Wallet) error {
+		w.Gold += proceeds
+		return nil
+	}); err != nil {
+		logger.Error("txWallet seller credit: %v", err)
+	}
+
+	item := listing.Item
+	if err := txInventory(ctx, nk, buyerID, func(inv *Inventory) error {
+		inv.Items[item.InstanceId] = item
+		return nil
+	}); err != nil {
+		// The buyer was already charged and the listing already claimed - refund
+		// the buyer and recreate the listing rather than losing the item.
+		if refundErr := txWallet(ctx, nk, buyerID, func(w *Wallet) error {
+			w.Gold += listing.PriceGold
+			return nil
+		}); refundErr != nil {
+			logger.Error("txWallet refund after failed transfer: %v", refundErr)
+		}
+		if restoreErr := restoreListing(ctx, nk, listing); restoreErr != nil {
+			logger.Error("restoreListing after failed transfer: %v", restoreErr)
+		}
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "inventory_conflict")
+		}
+		return errResp(CodeBadRequest, "failed_to_transfer_item")
+	}
+
+	if _, err := nk.LeaderboardRecordWrite(ctx, LeaderboardGoldEarnedFromSales, listing.SellerUserId, "", int64(proceeds), 0, nil, nil); err != nil {
+		logger.Error("LeaderboardRecordWrite: %v", err)
+	}
+
+	_, buyerWallet, _, _, err = ensureProfileAndWallet(ctx, nk, buyerID, "")
+	if err != nil {
+		return errResp(CodeBadRequest, "failed_to_load_wallet")
+	}
+
+	out := map[string]interface{}{"item": item, "wallet": buyerWallet}
+	raw, _ := json.Marshal(out)
+	return string(raw), nil
+}
+
+// --- RPC: rpc_cancel_listing ---
+
+type CancelListingPayload struct {
+	ListingId string `json:"listingId"`
+}
+
+func rpcCancelListing(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, err := mustGetUserId(ctx)
+	if err != nil {
+		return errResp(CodePermission, "user_id_required")
+	}
+	if payload == "" {
+		return errResp(CodeInvalidArg, "missing_payload")
+	}
+	var in CancelListingPayload
+	if err := json.Unmarshal([]byte(payload), &in); err != nil {
+		return errResp(CodeInvalidArg, "invalid_json")
+	}
+	if in.ListingId == "" {
+		return errResp(CodeInvalidArg, "missing_listingId")
+	}
+
+	listing, version, err := readListingWithVersion(ctx, nk, in.ListingId)
+	if err != nil {
+		logger.Error("readListingWithVersion: %v", err)
+		return errResp(CodeBadRequest, "failed_to_load_listing")
+	}
+	if listing == nil {
+		return errResp(CodeNotFound, "listing_not_found")
+	}
+	if listing.SellerUserId != userID {
+		return errResp(CodePermission, "not_listing_owner")
+	}
+
+	// Claim the listing before returning the item: if the escrow write below
+	// fails, the item stays safely represented by the listing instead of
+	// being duplicated into the seller's inventory while still for sale.
+	if err := claimListing(ctx, nk, in.ListingId, version); err != nil {
+		return errResp(CodeConflict, "listing_already_claimed")
+	}
+
+	item := listing.Item
+	if err := txInventory(ctx, nk, userID, func(inv *Inventory) error {
+		inv.Items[item.InstanceId] = item
+		return nil
+	}); err != nil {
+		// The listing is already gone - recreate it so the item isn't lost.
+		if restoreErr := restoreListing(ctx, nk, listing); restoreErr != nil {
+			logger.Error("restoreListing: %v", restoreErr)
+		}
+		if conflictErr, ok := err.(*runtime.Error); ok && conflictErr.Code == CodeConflict {
+			return errResp(CodeConflict, "inventory_conflict")
+		}
+		return errResp(CodeBadRequest, "failed_to_return_item")
+	}
+
+	out := map[string]interface{}{"item": item}
+	raw, _ := json.Marshal(out)
+	return string(raw), nil
+}